@@ -39,15 +39,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/config"
-	"github.com/prometheus/prometheus/pkg/labels"
 
+	"github.com/Stackdriver/stackdriver-prometheus-sidecar/logging"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/metadata"
+	"github.com/Stackdriver/stackdriver-prometheus-sidecar/remotewrite"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/retrieval"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/stackdriver"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/tail"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/targets"
-	"github.com/prometheus/common/promlog"
-	promlogflag "github.com/prometheus/common/promlog/flag"
 )
 
 func init() {
@@ -68,7 +67,13 @@ func main() {
 		prometheusURL      *url.URL
 		listenAddress      string
 
-		logLevel promlog.AllowedLevel
+		walCheckpointFile     string
+		walCheckpointInterval time.Duration
+		relabelConfigFile     string
+
+		logFormat          string
+		logLevel           string
+		logComponentLevels []string
 	}{
 		globalLabels: make(map[string]string),
 	}
@@ -93,13 +98,32 @@ func main() {
 	a.Flag("prometheus.wal-directory", "Directory from where to read the Prometheus TSDB WAL.").
 		Default("data/wal").StringVar(&cfg.walDirectory)
 
+	a.Flag("prometheus.wal-checkpoint-file", "File that stores the last WAL segment and offset handed to the output destinations, so a restart resumes from there instead of re-reading or skipping samples. The position is saved without waiting for the destinations to confirm delivery.").
+		Default("data/wal/sidecar_checkpoint.json").StringVar(&cfg.walCheckpointFile)
+
+	a.Flag("prometheus.wal-checkpoint-interval", "How often to fsync the WAL checkpoint file.").
+		Default(retrieval.DefaultCheckpointInterval.String()).DurationVar(&cfg.walCheckpointInterval)
+
 	a.Flag("prometheus.api-address", "Address to listen on for UI, API, and telemetry.").
 		Default("http://127.0.0.1:9090/").URLVar(&cfg.prometheusURL)
 
 	a.Flag("web.listen-address", "Address to listen on for UI, API, and telemetry.").
 		Default("0.0.0.0:9091").StringVar(&cfg.listenAddress)
 
-	promlogflag.AddFlags(a, &cfg.logLevel)
+	outputDestinations := a.Flag("output.destination", "Additional destination to fan out WAL samples to, as a remote_write endpoint URL (e.g. http://cortex:9009/api/v1/push). Repeat the flag for more than one. Stackdriver is always included and does not need to be listed here.").
+		Strings()
+
+	a.Flag("include.config-file", "YAML file with a relabel_configs stanza used to filter and relabel series before they are sent. Reloaded on SIGHUP.").
+		StringVar(&cfg.relabelConfigFile)
+
+	a.Flag("log.format", "Output format of log messages.").
+		Default(string(logging.FormatLogfmt)).StringVar(&cfg.logFormat)
+
+	a.Flag("log.level", "Default minimum level of messages to log.").
+		Default("info").StringVar(&cfg.logLevel)
+
+	a.Flag("log.component-level", "Per-component minimum log level override, as component=level (e.g. queue_manager=debug). Repeat the flag for more than one.").
+		StringsVar(&cfg.logComponentLevels)
 
 	_, err := a.Parse(os.Args[1:])
 	if err != nil {
@@ -108,7 +132,12 @@ func main() {
 		os.Exit(2)
 	}
 
-	logger := promlog.New(cfg.logLevel)
+	logFactory, err := logging.NewFactory(logging.Format(cfg.logFormat), cfg.logLevel, cfg.logComponentLevels)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := logFactory.With("main")
 
 	level.Info(logger).Log("msg", "Starting Stackdriver Prometheus sidecar", "version", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
@@ -121,7 +150,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	targetCache := targets.NewCache(logger, nil, targetsURL)
+	targetCache := targets.NewCache(logFactory.With("targets"), nil, targetsURL)
 
 	metadataURL, err := cfg.prometheusURL.Parse(metadata.DefaultEndpointPath)
 	if err != nil {
@@ -151,10 +180,10 @@ func main() {
 	config.DefaultQueueConfig.Capacity = 3 * stackdriver.MaxTimeseriesesPerRequest
 
 	queueManager, err := stackdriver.NewQueueManager(
-		log.With(logger, "component", "queue_manager"),
+		logFactory.With("queue_manager"),
 		config.DefaultQueueConfig,
 		&clientFactory{
-			logger:            log.With(logger, "component", "storage"),
+			logger:            logFactory.With("storage"),
 			projectIdResource: cfg.projectIdResource,
 			url:               cfg.stackdriverAddress,
 			timeout:           10 * time.Second,
@@ -165,13 +194,33 @@ func main() {
 		fmt.Fprintln(os.Stderr, "Creating queue manager failed:", err)
 		os.Exit(1)
 	}
+
+	sinks := map[string]retrieval.Appender{"stackdriver": queueManager}
+	for _, dest := range *outputDestinations {
+		destURL, err := url.Parse(dest)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid --output.destination:", err)
+			os.Exit(2)
+		}
+		client := remotewrite.NewClient(&remotewrite.ClientConfig{
+			Logger:  log.With(logFactory.With("remote_write"), "destination", dest),
+			URL:     destURL,
+			Timeout: 10 * time.Second,
+		})
+		sinks[dest] = retrieval.NewRemoteWriteAppender(log.With(logFactory.With("remote_write"), "destination", dest), client)
+	}
+	appender := retrieval.NewMultiAppender(logFactory.With("appender"), sinks)
+
+	// TODO(jkohen): thread discovered target labels from targetCache through
+	// once the reader grows a relabeling stage for them.
 	prometheusReader := retrieval.NewPrometheusReader(
-		log.With(logger, "component", "Prometheus reader"),
+		logFactory,
 		cfg.walDirectory,
-		tailer,
-		retrieval.TargetsWithDiscoveredLabels(targetCache, labels.FromMap(cfg.globalLabels)),
 		metadataCache,
-		queueManager,
+		appender,
+		cfg.walCheckpointFile,
+		cfg.walCheckpointInterval,
+		cfg.relabelConfigFile,
 	)
 
 	// Exclude kingpin default flags to expose only Prometheus ones.
@@ -220,6 +269,28 @@ func main() {
 			},
 		)
 	}
+	if cfg.relabelConfigFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				for {
+					select {
+					case <-hup:
+						if err := prometheusReader.ReloadRelabelConfig(); err != nil {
+							level.Error(logger).Log("msg", "Error reloading relabel config", "err", err)
+						}
+					case <-cancel:
+						return nil
+					}
+				}
+			},
+			func(err error) {
+				close(cancel)
+			},
+		)
+	}
 	{
 		// We use the context we defined higher up instead of a local one like in the other actors.
 		// This is necessary since it's also used to manage the tailer's lifecycle, which the reader
@@ -235,6 +306,10 @@ func main() {
 				}
 				err := prometheusReader.Run(ctx)
 				level.Info(logger).Log("msg", "Prometheus reader stopped")
+				// The reader has stopped appending, so it's now safe to
+				// close the sinks and flush whatever they still have
+				// buffered instead of dropping it on process exit.
+				appender.Close()
 				return err
 			},
 			func(err error) {
@@ -0,0 +1,143 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// DefaultSamplerBurst is how many lines per second per distinct message a
+// Sampler emits before it starts counting instead, if the caller doesn't
+// pick its own burst size.
+const DefaultSamplerBurst = 10
+
+// flushInterval is how often Run checks for windows whose second has
+// closed and which still have a nonzero suppressed count to report.
+const flushInterval = time.Second
+
+// window tracks one message's sampling state for the second currently in
+// progress.
+type window struct {
+	msg        string
+	start      time.Time
+	count      int
+	suppressed int
+	example    []interface{}
+}
+
+// Sampler rate-limits a logger down to the first burst lines per second for
+// a given message. A background goroutine started by Run periodically
+// emits a summary line with the suppressed count and a representative
+// example for any message whose second has closed, independently of
+// whether that message is ever logged again. This keeps a WAL replay
+// after a restart, which can otherwise produce millions of "Unknown
+// series ref" / "Cannot construct MetricFamily" lines a minute, from
+// flooding stderr, without losing the final count when the flood stops
+// mid-window.
+type Sampler struct {
+	logger log.Logger
+	burst  int
+
+	mtx     sync.Mutex
+	windows map[string]*window
+}
+
+// NewSampler builds a Sampler that logs at most burst lines per second for
+// any given message logged through it. Call Run to start the periodic
+// summary flush.
+func NewSampler(logger log.Logger, burst int) *Sampler {
+	if burst <= 0 {
+		burst = DefaultSamplerBurst
+	}
+	return &Sampler{logger: logger, burst: burst, windows: make(map[string]*window)}
+}
+
+// Run periodically flushes the summary line for every message whose
+// sampling window has closed, i.e. started at least flushInterval ago. It
+// blocks until ctx is canceled.
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.flushExpired(now)
+		}
+	}
+}
+
+func (s *Sampler) flushExpired(now time.Time) {
+	s.mtx.Lock()
+	var expired []*window
+	for msg, w := range s.windows {
+		if now.Sub(w.start) < flushInterval {
+			continue
+		}
+		if w.suppressed > 0 {
+			expired = append(expired, w)
+		}
+		delete(s.windows, msg)
+	}
+	s.mtx.Unlock()
+
+	for _, w := range expired {
+		s.logSuppressed(w)
+	}
+}
+
+// Warn logs msg and keyvals at Warn level, subject to sampling.
+func (s *Sampler) Warn(msg string, keyvals ...interface{}) {
+	s.mtx.Lock()
+	w, ok := s.windows[msg]
+	now := time.Now()
+	var stale *window
+	if !ok || now.Sub(w.start) >= flushInterval {
+		// The previous window for msg, if any, is about to be replaced and
+		// will never be seen by flushExpired's scan again, so its
+		// suppressed count must be reported here instead of being lost.
+		if ok && w.suppressed > 0 {
+			stale = w
+		}
+		w = &window{msg: msg, start: now}
+		s.windows[msg] = w
+	}
+	w.count++
+	emit := w.count <= s.burst
+	if !emit {
+		w.suppressed++
+		w.example = keyvals
+	}
+	s.mtx.Unlock()
+
+	if stale != nil {
+		s.logSuppressed(stale)
+	}
+	if emit {
+		level.Warn(s.logger).Log(append([]interface{}{"msg", msg}, keyvals...)...)
+	}
+}
+
+func (s *Sampler) logSuppressed(w *window) {
+	level.Warn(s.logger).Log(append([]interface{}{
+		"msg", w.msg + ": suppressed further occurrences in the last second",
+		"suppressed", w.suppressed,
+	}, w.example...)...)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remotewrite implements a client for the Prometheus remote_write
+// protocol, so the sidecar can dual-ship WAL samples to Cortex, Mimir,
+// Thanos or any other remote_write receiver alongside Stackdriver.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	Logger  log.Logger
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+// Client sends snappy-compressed prompb.WriteRequest messages to a
+// Prometheus remote_write endpoint.
+type Client struct {
+	logger     log.Logger
+	url        *url.URL
+	httpClient *http.Client
+}
+
+// NewClient is the Client constructor.
+func NewClient(cfg *ClientConfig) *Client {
+	return &Client{
+		logger:     cfg.Logger,
+		url:        cfg.URL,
+		httpClient: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// Name identifies this client among the sidecar's configured sinks.
+func (c *Client) Name() string {
+	return c.url.String()
+}
+
+// Store marshals, compresses and POSTs req to the remote_write endpoint.
+func (c *Client) Store(ctx context.Context, req *prompb.WriteRequest) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "marshal WriteRequest")
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequest("POST", c.url.String(), bytes.NewReader(compressed))
+	if err != nil {
+		return errors.Wrap(err, "create remote_write request")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "send remote_write request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		level.Warn(c.logger).Log("msg", "remote_write request failed", "status", resp.Status)
+		return errors.Errorf("remote_write endpoint %s returned %s", c.url, resp.Status)
+	}
+	return nil
+}
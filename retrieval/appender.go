@@ -0,0 +1,137 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sinkSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_sink_sent_total",
+		Help: "Number of metric families passed from a sink's queue to the sink.",
+	}, []string{"sink"})
+	sinkFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_sink_failed_total",
+		Help: "Number of batched requests a sink failed to send.",
+	}, []string{"sink"})
+	sinkDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_sink_dropped_total",
+		Help: "Number of metric families dropped because a sink's queue was full.",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkSentTotal, sinkFailedTotal, sinkDroppedTotal)
+}
+
+// defaultSinkQueueCapacity bounds how many metric families a sink can be
+// behind by before new ones are dropped rather than blocking every other
+// sink.
+const defaultSinkQueueCapacity = 10000
+
+// sinkShards is the number of goroutines draining each sink's queue.
+const sinkShards = 4
+
+// sinkAppender wraps a single backing Appender with its own bounded queue
+// and worker shards, so a stalled or slow sink cannot back-pressure the
+// others beyond the queue's capacity.
+type sinkAppender struct {
+	name   string
+	logger log.Logger
+	next   Appender
+	queue  chan *MetricFamily
+	wg     sync.WaitGroup
+}
+
+func newSinkAppender(logger log.Logger, name string, next Appender) *sinkAppender {
+	s := &sinkAppender{
+		name:   name,
+		logger: logger,
+		next:   next,
+		queue:  make(chan *MetricFamily, defaultSinkQueueCapacity),
+	}
+	s.wg.Add(sinkShards)
+	for i := 0; i < sinkShards; i++ {
+		go s.run()
+	}
+	return s
+}
+
+func (s *sinkAppender) run() {
+	defer s.wg.Done()
+	for f := range s.queue {
+		s.next.Append(f)
+		sinkSentTotal.WithLabelValues(s.name).Inc()
+	}
+}
+
+// Append enqueues f for this sink, dropping it instead of blocking if the
+// sink has fallen too far behind.
+func (s *sinkAppender) Append(f *MetricFamily) {
+	select {
+	case s.queue <- f:
+	default:
+		sinkDroppedTotal.WithLabelValues(s.name).Inc()
+		level.Warn(s.logger).Log("msg", "Sink queue full, dropping metric family", "sink", s.name, "metric", f.GetName())
+	}
+}
+
+// Close closes the queue and blocks until every worker has drained
+// whatever was already buffered in it, then closes the wrapped sink if it
+// supports it, so a sink that itself buffers (such as remoteWriteAppender)
+// flushes before shutdown completes.
+func (s *sinkAppender) Close() {
+	close(s.queue)
+	s.wg.Wait()
+	if closer, ok := s.next.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// MultiAppender fans every appended metric family out to N independently
+// queued sinks. Each sink in sinks implements Appender and is wrapped in
+// its own sinkAppender, so one sink stalling (e.g. Stackdriver throttling,
+// or a remote_write receiver being unreachable) cannot hold back the
+// others.
+type MultiAppender struct {
+	sinks []*sinkAppender
+}
+
+// NewMultiAppender constructs a MultiAppender from a name-to-sink map. The
+// names are used as the "sink" label on the sidecar_sink_* metrics.
+func NewMultiAppender(logger log.Logger, sinks map[string]Appender) *MultiAppender {
+	m := &MultiAppender{}
+	for name, sink := range sinks {
+		m.sinks = append(m.sinks, newSinkAppender(log.With(logger, "sink", name), name, sink))
+	}
+	return m
+}
+
+func (m *MultiAppender) Append(f *MetricFamily) {
+	for _, s := range m.sinks {
+		s.Append(f)
+	}
+}
+
+// Close drains and stops every sink's workers.
+func (m *MultiAppender) Close() {
+	for _, s := range m.sinks {
+		s.Close()
+	}
+}
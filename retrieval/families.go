@@ -0,0 +1,337 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/scrape"
+)
+
+// familyGroupTimeout bounds how long the family builder waits for the
+// siblings of a histogram or summary series to show up in the WAL before it
+// gives up on reconstructing the family and falls back to emitting whatever
+// it has buffered as untyped samples.
+const familyGroupTimeout = 2 * time.Minute
+
+// MetadataGetter resolves the declared Prometheus type and help text for a
+// metric family name. *metadata.Cache implements this.
+type MetadataGetter interface {
+	Get(ctx context.Context, job, instance, metric string) (*scrape.MetricMetadata, error)
+}
+
+// familyKey identifies the siblings of a single histogram or summary scrape:
+// the family name, the scrape timestamp, and the fingerprint of the labels
+// shared by all its siblings (i.e. everything but __name__, le and
+// quantile).
+type familyKey struct {
+	name string
+	t    int64
+	fp   uint64
+}
+
+// pendingFamily accumulates the sibling series of one histogram or summary
+// scrape until it is either complete or times out.
+type pendingFamily struct {
+	typ              textparse.MetricType
+	labels           labels.Labels
+	buckets          map[float64]float64 // le -> cumulative count, as Prometheus wrote it
+	quantiles        map[float64]float64
+	sum              float64
+	count            float64
+	hasSum           bool
+	hasCount         bool
+	resetTimestampMs int64 // from the _count series, which is representative of the whole family
+	firstSeenAt      time.Time
+}
+
+// familyResult pairs a reconstructed metric family with the reset
+// timestamp Stackdriver needs as the start time of its CUMULATIVE point.
+type familyResult struct {
+	family           *dto.MetricFamily
+	resetTimestampMs int64
+}
+
+// familyBuilder reconstructs the dto.MetricFamily that Prometheus originally
+// scraped for histogram and summary metrics out of the individual
+// "_bucket"/"_sum"/"_count" (or "_sum"/"_count"/quantile) series the TSDB
+// stores them as. Series whose declared type is a plain counter, gauge or
+// untyped value pass straight through unchanged.
+type familyBuilder struct {
+	logger   log.Logger
+	metadata MetadataGetter
+	resets   *resetTracker
+	pending  map[familyKey]*pendingFamily
+}
+
+func newFamilyBuilder(logger log.Logger, metadata MetadataGetter, resets *resetTracker) *familyBuilder {
+	return &familyBuilder{
+		logger:   logger,
+		metadata: metadata,
+		resets:   resets,
+		pending:  make(map[familyKey]*pendingFamily),
+	}
+}
+
+// add ingests one WAL sample. It returns the metric families that are ready
+// to be appended, which may be empty if the sample was buffered as part of
+// an incomplete histogram or summary.
+func (b *familyBuilder) add(ctx context.Context, ref uint64, lset labels.Labels, t int64, v float64) []familyResult {
+	name := lset.Get(labels.MetricName)
+	base, part := splitMetricSuffix(name)
+	if part == "" && lset.Get("quantile") != "" {
+		// Summary quantiles keep the bare family name, e.g.
+		// name{quantile="0.5"}, unlike _sum/_count/_bucket.
+		base, part = name, "quantile"
+	}
+	resetTimestampMs := b.resets.getResetTimestamp(ref, v, t)
+
+	meta, err := b.metadata.Get(ctx, lset.Get("job"), lset.Get("instance"), base)
+	if err != nil || meta == nil || part == "" ||
+		(meta.Type != textparse.MetricTypeHistogram && meta.Type != textparse.MetricTypeSummary) {
+		return []familyResult{{family: b.untyped(name, meta, lset, t, v), resetTimestampMs: resetTimestampMs}}
+	}
+
+	shared := stripLabels(lset, labels.MetricName, "le", "quantile")
+	key := familyKey{name: base, t: t, fp: shared.Hash()}
+	pf, ok := b.pending[key]
+	if !ok {
+		pf = &pendingFamily{
+			typ:         meta.Type,
+			labels:      shared,
+			buckets:     make(map[float64]float64),
+			quantiles:   make(map[float64]float64),
+			firstSeenAt: time.Now(),
+		}
+		b.pending[key] = pf
+	}
+
+	switch {
+	case part == "bucket" && meta.Type == textparse.MetricTypeHistogram:
+		le, err := strconv.ParseFloat(lset.Get("le"), 64)
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "Cannot parse le label", "metric", name, "err", err)
+			break
+		}
+		pf.buckets[le] = v
+	case part == "quantile" && meta.Type == textparse.MetricTypeSummary:
+		q, err := strconv.ParseFloat(lset.Get("quantile"), 64)
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "Cannot parse quantile label", "metric", name, "err", err)
+			break
+		}
+		pf.quantiles[q] = v
+	case part == "sum":
+		pf.sum, pf.hasSum = v, true
+	case part == "count":
+		// The _count series is monotonic and resets exactly when the
+		// family resets, so it is the representative for the whole group.
+		pf.count, pf.hasCount = v, true
+		pf.resetTimestampMs = resetTimestampMs
+	}
+
+	if !b.complete(pf) {
+		return nil
+	}
+	delete(b.pending, key)
+	return []familyResult{{family: b.build(base, meta, pf, t), resetTimestampMs: pf.resetTimestampMs}}
+}
+
+// sweep flushes any family that has been waiting longer than
+// familyGroupTimeout for its missing siblings, emitting whatever was
+// buffered as untyped samples so no data is silently dropped.
+func (b *familyBuilder) sweep(now time.Time) []familyResult {
+	var out []familyResult
+	for key, pf := range b.pending {
+		if now.Sub(pf.firstSeenAt) < familyGroupTimeout {
+			continue
+		}
+		level.Warn(b.logger).Log("msg", "Timed out waiting for histogram/summary siblings, falling back to untyped", "metric", key.name)
+		out = append(out, b.flushUntyped(key, pf)...)
+		delete(b.pending, key)
+	}
+	return out
+}
+
+// drainAll flushes every still-pending family regardless of how long it has
+// been waiting, emitting whatever was buffered as untyped samples. Unlike
+// sweep, it is meant for a graceful shutdown, where no more siblings are
+// ever coming and holding out for familyGroupTimeout would just drop them.
+func (b *familyBuilder) drainAll() []familyResult {
+	var out []familyResult
+	for key, pf := range b.pending {
+		out = append(out, b.flushUntyped(key, pf)...)
+		delete(b.pending, key)
+	}
+	return out
+}
+
+func (b *familyBuilder) complete(pf *pendingFamily) bool {
+	if !pf.hasSum || !pf.hasCount {
+		return false
+	}
+	if pf.typ == textparse.MetricTypeHistogram {
+		// A Prometheus histogram always has a +Inf bucket.
+		_, ok := pf.buckets[math.Inf(1)]
+		return ok
+	}
+	return true
+}
+
+func (b *familyBuilder) build(name string, meta *scrape.MetricMetadata, pf *pendingFamily, t int64) *dto.MetricFamily {
+	metric := &dto.Metric{
+		Label:       labelPairs(pf.labels),
+		TimestampMs: proto.Int64(t),
+	}
+	mf := &dto.MetricFamily{
+		Name:   proto.String(name),
+		Help:   proto.String(meta.Help),
+		Metric: []*dto.Metric{metric},
+	}
+	if pf.typ == textparse.MetricTypeHistogram {
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		h := &dto.Histogram{
+			SampleSum:   proto.Float64(pf.sum),
+			SampleCount: proto.Uint64(uint64(pf.count)),
+		}
+		for le, count := range pf.buckets {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(le),
+				CumulativeCount: proto.Uint64(uint64(count)),
+			})
+		}
+		metric.Histogram = h
+	} else {
+		mf.Type = dto.MetricType_SUMMARY.Enum()
+		s := &dto.Summary{
+			SampleSum:   proto.Float64(pf.sum),
+			SampleCount: proto.Uint64(uint64(pf.count)),
+		}
+		for q, v := range pf.quantiles {
+			s.Quantile = append(s.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(q),
+				Value:    proto.Float64(v),
+			})
+		}
+		metric.Summary = s
+	}
+	return mf
+}
+
+// flushUntyped turns whatever was buffered for an incomplete family into
+// individual untyped series, preserving the original per-component names.
+func (b *familyBuilder) flushUntyped(key familyKey, pf *pendingFamily) []familyResult {
+	var out []familyResult
+	emit := func(suffix string, label string, labelVal float64, v float64) {
+		lset := pf.labels
+		if label != "" {
+			lset = append(append(labels.Labels{}, pf.labels...), labels.Label{Name: label, Value: strconv.FormatFloat(labelVal, 'g', -1, 64)})
+		}
+		out = append(out, familyResult{family: b.untyped(key.name+suffix, nil, lset, key.t, v), resetTimestampMs: pf.resetTimestampMs})
+	}
+	for le, v := range pf.buckets {
+		emit("_bucket", "le", le, v)
+	}
+	for q, v := range pf.quantiles {
+		emit("", "quantile", q, v)
+	}
+	if pf.hasSum {
+		emit("_sum", "", 0, pf.sum)
+	}
+	if pf.hasCount {
+		emit("_count", "", 0, pf.count)
+	}
+	return out
+}
+
+func (b *familyBuilder) untyped(name string, meta *scrape.MetricMetadata, lset labels.Labels, t int64, v float64) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{{
+			Label:       labelPairs(stripLabels(lset, labels.MetricName)),
+			TimestampMs: proto.Int64(t),
+			Untyped:     &dto.Untyped{Value: proto.Float64(v)},
+		}},
+	}
+	if meta != nil {
+		mf.Help = proto.String(meta.Help)
+	}
+	return mf
+}
+
+func labelPairs(lset labels.Labels) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(lset))
+	for _, l := range lset {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	}
+	return pairs
+}
+
+// stripLabels returns a copy of lset with the given label names removed.
+func stripLabels(lset labels.Labels, names ...string) labels.Labels {
+	drop := make(map[string]bool, len(names))
+	for _, n := range names {
+		drop[n] = true
+	}
+	out := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if !drop[l.Name] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// labelsFromMetricFamily reconstructs a labels.Labels from a single-metric
+// dto.MetricFamily, for callers that only have the family left to build the
+// target labels from, such as the sweep() fallback path.
+func labelsFromMetricFamily(mf *dto.MetricFamily) labels.Labels {
+	out := make(labels.Labels, 0, len(mf.Metric[0].Label)+1)
+	out = append(out, labels.Label{Name: labels.MetricName, Value: mf.GetName()})
+	for _, l := range mf.Metric[0].Label {
+		out = append(out, labels.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	return out
+}
+
+// splitMetricSuffix splits a metric name into its histogram/summary family
+// base name and the component it names ("bucket", "sum" or "count"). Summary
+// quantile series carry no suffix at all (name{quantile="0.5"}), so callers
+// detect those separately from the "quantile" label and treat an empty part
+// here as "not a bucket/sum/count series". The "le" and "quantile" label
+// values themselves are read separately from the sample's label set.
+func splitMetricSuffix(name string) (base, part string) {
+	switch {
+	case strings.HasSuffix(name, "_bucket"):
+		return strings.TrimSuffix(name, "_bucket"), "bucket"
+	case strings.HasSuffix(name, "_sum"):
+		return strings.TrimSuffix(name, "_sum"), "sum"
+	case strings.HasSuffix(name, "_count"):
+		return strings.TrimSuffix(name, "_count"), "count"
+	default:
+		return name, ""
+	}
+}
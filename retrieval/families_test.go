@@ -0,0 +1,84 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/scrape"
+)
+
+// fakeMetadataGetter reports every metric as having the configured type, as
+// if it came from a single scrape target.
+type fakeMetadataGetter struct {
+	typ textparse.MetricType
+}
+
+func (f fakeMetadataGetter) Get(ctx context.Context, job, instance, metric string) (*scrape.MetricMetadata, error) {
+	return &scrape.MetricMetadata{MetricFamily: metric, Type: f.typ, Help: "help"}, nil
+}
+
+func TestFamilyBuilderSummaryQuantiles(t *testing.T) {
+	const base = "http_request_duration_seconds"
+
+	mkLabels := func(name string, extra ...labels.Label) labels.Labels {
+		lset := labels.Labels{
+			{Name: "__name__", Value: name},
+			{Name: "job", Value: "j"},
+			{Name: "instance", Value: "i"},
+		}
+		return append(lset, extra...)
+	}
+
+	logger := log.NewNopLogger()
+	resets := newResetTracker(logger, t.TempDir())
+	b := newFamilyBuilder(logger, fakeMetadataGetter{typ: textparse.MetricTypeSummary}, resets)
+
+	cases := []struct {
+		ref   uint64
+		lset  labels.Labels
+		value float64
+	}{
+		// Quantiles keep the bare family name; only the "quantile" label
+		// tells them apart from each other and from _sum/_count.
+		{1, mkLabels(base, labels.Label{Name: "quantile", Value: "0.5"}), 1.5},
+		{2, mkLabels(base, labels.Label{Name: "quantile", Value: "0.9"}), 4.2},
+		{3, mkLabels(base + "_sum"), 12.3},
+		{4, mkLabels(base + "_count"), 7},
+	}
+
+	const scrapeTimestamp = 1000 // All four siblings come from the same scrape.
+
+	var got []familyResult
+	for _, c := range cases {
+		got = append(got, b.add(context.Background(), c.ref, c.lset, scrapeTimestamp, c.value)...)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("want exactly one reconstructed family once _sum and _count have both arrived, got %d", len(got))
+	}
+	mf := got[0].family
+	if mf.GetType() != dto.MetricType_SUMMARY {
+		t.Fatalf("want a SUMMARY family, got %v", mf.GetType())
+	}
+	quantiles := mf.Metric[0].GetSummary().GetQuantile()
+	if len(quantiles) != 2 {
+		t.Fatalf("want both quantile series folded into the family, got %d: %v", len(quantiles), quantiles)
+	}
+}
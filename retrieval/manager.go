@@ -15,32 +15,54 @@ package retrieval
 
 import (
 	"context"
+	"time"
 
+	"github.com/Stackdriver/stackdriver-prometheus-sidecar/logging"
+	"github.com/Stackdriver/stackdriver-prometheus-sidecar/metadata"
 	"github.com/Stackdriver/stackdriver-prometheus-sidecar/tail"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/gogo/protobuf/proto"
 
-	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/wal"
 )
 
 // NewPrometheusReader is the PrometheusReader constructor
-func NewPrometheusReader(logger log.Logger, walDirectory string, appender Appender) *PrometheusReader {
+func NewPrometheusReader(logFactory *logging.Factory, walDirectory string, metadataCache *metadata.Cache, appender Appender, checkpointFile string, checkpointInterval time.Duration, relabelConfigFile string) *PrometheusReader {
+	if checkpointInterval <= 0 {
+		checkpointInterval = DefaultCheckpointInterval
+	}
 	return &PrometheusReader{
-		appender:     appender,
-		logger:       logger,
-		walDirectory: walDirectory,
+		appender:           appender,
+		logFactory:         logFactory,
+		logger:             logFactory.With("prometheus_reader"),
+		walDirectory:       walDirectory,
+		metadataCache:      metadataCache,
+		checkpointFile:     checkpointFile,
+		checkpointInterval: checkpointInterval,
+		relabel:            newRelabelFilter(logFactory.With("relabel"), relabelConfigFile),
+		sampler:            logging.NewSampler(logFactory.With("prometheus_reader"), logging.DefaultSamplerBurst),
 	}
 }
 
 type PrometheusReader struct {
-	logger       log.Logger
-	walDirectory string
-	appender     Appender
-	cancelTail   context.CancelFunc
+	logFactory         *logging.Factory
+	logger             log.Logger
+	walDirectory       string
+	metadataCache      *metadata.Cache
+	appender           Appender
+	checkpointFile     string
+	checkpointInterval time.Duration
+	relabel            *relabelFilter
+	sampler            *logging.Sampler
+	cancelTail         context.CancelFunc
+}
+
+// ReloadRelabelConfig re-reads the --include.config-file rules from disk.
+// It is safe to call while Run is in progress, e.g. from a SIGHUP handler.
+func (r *PrometheusReader) ReloadRelabelConfig() error {
+	return r.relabel.Reload()
 }
 
 func (r *PrometheusReader) Run() error {
@@ -52,15 +74,33 @@ func (r *PrometheusReader) Run() error {
 		level.Error(r.logger).Log("error", err)
 		return err
 	}
-	seriesCache := newSeriesCache(r.logger, r.walDirectory)
+	seriesCache := newSeriesCache(r.logFactory.With("series_cache"), r.walDirectory)
 	go seriesCache.run(ctx)
+	go r.sampler.Run(ctx)
+
+	resets := newResetTracker(r.logFactory.With("reset_tracker"), r.walDirectory)
+	families := newFamilyBuilder(r.logFactory.With("family_builder"), r.metadataCache, resets)
+	progress := NewProgress(r.logFactory.With("progress"), r.checkpointFile)
 
 	// NOTE(fabxc): wrap the tailer into a buffered reader once we become concerned
 	// with performance. The WAL reader will do a lot of tiny reads otherwise.
 	// This is also the reason for the series cache dealing with "maxSegment" hints
 	// for series rather than precise ones.
 	reader := wal.NewReader(tailer)
-	for reader.Next() {
+	pending, err := progress.SeekReader(reader)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "Cannot resume from WAL checkpoint", "err", err)
+		return err
+	}
+
+	lastCheckpoint := time.Now()
+	var processed int
+
+	// processRecord handles the record reader is currently positioned on.
+	// It's factored out of the loop below so the record SeekReader had to
+	// read in order to discover a gap (and therefore couldn't discard) can
+	// be processed once before the loop starts calling reader.Next() again.
+	processRecord := func() error {
 		if reader.Err() != nil {
 			return reader.Err()
 		}
@@ -71,7 +111,7 @@ func (r *PrometheusReader) Run() error {
 			recordSeries, err := decoder.Series(record, nil)
 			if err != nil {
 				level.Error(r.logger).Log("error", err)
-				continue
+				return nil
 			}
 			for _, series := range recordSeries {
 				seriesCache.set(series.Ref, series.Labels, tailer.CurrentSegment())
@@ -80,51 +120,103 @@ func (r *PrometheusReader) Run() error {
 			recordSamples, err := decoder.Samples(record, nil)
 			if err != nil {
 				level.Error(r.logger).Log("error", err)
-				continue
+				return nil
 			}
 			for _, sample := range recordSamples {
 				lset, ok := seriesCache.get(sample.Ref)
 				if !ok {
-					level.Warn(r.logger).Log("msg", "Unknown series ref in sample", "sample", sample)
+					r.sampler.Warn("Unknown series ref in sample", "series_ref", sample.Ref, "sample_ts", sample.T)
 					continue
 				}
-				// TODO(jkohen): Rebuild histograms and summary from individual time series.
-				metricFamily := &dto.MetricFamily{
-					Metric: []*dto.Metric{{}},
+				relabeledLset, keep := r.relabel.Filter(lset)
+				if !keep {
+					continue
 				}
-				metric := metricFamily.Metric[0]
-				metric.Label = make([]*dto.LabelPair, 0, len(lset)-1)
-				for _, l := range lset {
-					if l.Name == labels.MetricName {
-						metricFamily.Name = proto.String(l.Value)
+				// families resolves metadata and groups histogram/summary
+				// siblings by job/instance from the original scrape labels,
+				// since relabeling commonly rewrites job/instance to match
+				// Stackdriver monitored-resource conventions and would
+				// otherwise break the metadata cache lookup. Relabeling is
+				// only applied to the labels that end up on the appended
+				// point, below.
+				for _, result := range families.add(ctx, sample.Ref, lset, sample.T, sample.V) {
+					// TODO(jkohen): fill in the discovered labels from the Targets API.
+					targetLabels := make(labels.Labels, 0, len(relabeledLset))
+					for _, l := range relabeledLset {
+						targetLabels = append(targetLabels, labels.Label(l))
+					}
+					f, err := NewMetricFamily(result.family, []int64{result.resetTimestampMs}, targetLabels)
+					if err != nil {
+						r.sampler.Warn("Cannot construct MetricFamily", "series_ref", sample.Ref, "err", err)
 						continue
 					}
-					metric.Label = append(metric.Label, &dto.LabelPair{
-						Name:  proto.String(l.Name),
-						Value: proto.String(l.Value),
-					})
+					r.appender.Append(f)
 				}
-				// TODO(jkohen): Support all metric types and populate Help metadata.
-				metricFamily.Type = dto.MetricType_UNTYPED.Enum()
-				metric.Untyped = &dto.Untyped{Value: proto.Float64(sample.V)}
-				metric.TimestampMs = proto.Int64(sample.T)
-				// TODO(jkohen): track reset timestamps.
-				metricResetTimestampMs := []int64{NoTimestamp}
-				// TODO(jkohen): fill in the discovered labels from the Targets API.
-				targetLabels := make(labels.Labels, 0, len(lset))
-				for _, l := range lset {
-					targetLabels = append(targetLabels, labels.Label(l))
-				}
-				f, err := NewMetricFamily(metricFamily, metricResetTimestampMs, targetLabels)
-				if err != nil {
-					level.Warn(r.logger).Log("msg", "Cannot construct MetricFamily", "err", err)
-					continue
+				processed++
+				// Periodically give up on histogram/summary families whose
+				// siblings never showed up, rather than buffering them
+				// forever, and persist the reset tracker state so a
+				// restart doesn't look like every series reset.
+				if processed%1000 == 0 {
+					for _, result := range families.sweep(time.Now()) {
+						f, err := NewMetricFamily(result.family, []int64{result.resetTimestampMs}, labelsFromMetricFamily(result.family))
+						if err != nil {
+							r.sampler.Warn("Cannot construct MetricFamily", "metric", result.family.GetName(), "err", err)
+							continue
+						}
+						r.appender.Append(f)
+					}
+					if err := resets.persist(); err != nil {
+						level.Warn(r.logger).Log("msg", "Cannot persist reset tracker state", "segment", reader.Segment(), "err", err)
+					}
 				}
-				r.appender.Append(f)
 			}
 		case tsdb.RecordTombstones:
 		}
+
+		progress.Set(reader.Segment(), reader.Offset())
+		progress.UpdateLag(tailer.CurrentSegment())
+		if time.Since(lastCheckpoint) >= r.checkpointInterval {
+			if err := progress.Save(); err != nil {
+				level.Warn(r.logger).Log("msg", "Cannot save WAL checkpoint", "err", err)
+			}
+			lastCheckpoint = time.Now()
+		}
+		return nil
+	}
+
+	if pending {
+		if err := processRecord(); err != nil {
+			return err
+		}
+	}
+	for reader.Next() {
+		if err := processRecord(); err != nil {
+			return err
+		}
+	}
+
+	// Run is exiting, whether because the tailer hit EOF after Stop canceled
+	// its context or because the WAL is simply exhausted. Either way, give
+	// the same flush-on-exit care to the WAL checkpoint, reset tracker, and
+	// any still-buffered incomplete histogram/summary families that we give
+	// appender.Close(), so a clean restart doesn't resend, reset, or drop
+	// data it already had in hand.
+	for _, result := range families.drainAll() {
+		f, err := NewMetricFamily(result.family, []int64{result.resetTimestampMs}, labelsFromMetricFamily(result.family))
+		if err != nil {
+			r.sampler.Warn("Cannot construct MetricFamily", "metric", result.family.GetName(), "err", err)
+			continue
+		}
+		r.appender.Append(f)
 	}
+	if err := resets.persist(); err != nil {
+		level.Warn(r.logger).Log("msg", "Cannot persist reset tracker state", "segment", reader.Segment(), "err", err)
+	}
+	if err := progress.Save(); err != nil {
+		level.Warn(r.logger).Log("msg", "Cannot save WAL checkpoint", "err", err)
+	}
+
 	level.Info(r.logger).Log("msg", "Done processing WAL.")
 	return nil
 }
@@ -132,4 +224,4 @@ func (r *PrometheusReader) Run() error {
 // Stop cancels the reader and blocks until it has exited.
 func (r *PrometheusReader) Stop() {
 	r.cancelTail()
-}
\ No newline at end of file
+}
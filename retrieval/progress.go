@@ -0,0 +1,160 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/wal"
+)
+
+var (
+	readSegment = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sidecar_wal_read_segment",
+		Help: "The WAL segment the sidecar is currently reading.",
+	})
+	readOffset = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sidecar_wal_read_offset_bytes",
+		Help: "The byte offset within the current WAL segment the sidecar is currently reading.",
+	})
+	readLagSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sidecar_wal_read_lag_segments",
+		Help: "Number of WAL segments the sidecar is behind the newest segment available to read.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(readSegment, readOffset, readLagSegments)
+}
+
+// DefaultCheckpointInterval is how often Progress fsyncs its position to
+// disk if the caller doesn't override it with
+// --prometheus.wal-checkpoint-interval.
+const DefaultCheckpointInterval = 30 * time.Second
+
+// checkpoint is the on-disk representation of a Progress position.
+type checkpoint struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Progress tracks the {segment, offset} position PrometheusReader has
+// passed to its appender up to, fsyncing it to path so a restart can resume
+// tailing from there instead of re-reading already-handled samples or
+// skipping ones written while the sidecar was down. The position is recorded
+// without waiting for the appender's sinks to confirm delivery.
+type Progress struct {
+	logger log.Logger
+	path   string
+
+	segment int
+	offset  int64
+}
+
+// NewProgress loads any checkpoint already on disk at path, or starts fresh
+// if there is none.
+func NewProgress(logger log.Logger, path string) *Progress {
+	p := &Progress{logger: logger, path: path, segment: -1}
+	p.load()
+	return p
+}
+
+// Position returns the last checkpointed {segment, offset}, and whether a
+// checkpoint was found at all.
+func (p *Progress) Position() (segment int, offset int64, ok bool) {
+	return p.segment, p.offset, p.segment >= 0
+}
+
+// Set records the current read position. It does not write to disk; call
+// Save for that.
+func (p *Progress) Set(segment int, offset int64) {
+	p.segment, p.offset = segment, offset
+	readSegment.Set(float64(segment))
+	readOffset.Set(float64(offset))
+}
+
+// Save fsyncs the current position to disk.
+func (p *Progress) Save() error {
+	tmp := p.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(checkpoint{Segment: p.segment, Offset: p.offset}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+func (p *Progress) load() {
+	f, err := os.Open(p.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(p.logger).Log("msg", "Cannot read WAL checkpoint, starting from the oldest available segment", "err", err)
+		}
+		return
+	}
+	defer f.Close()
+	var c checkpoint
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		level.Warn(p.logger).Log("msg", "Cannot decode WAL checkpoint, starting from the oldest available segment", "err", err)
+		return
+	}
+	p.segment, p.offset = c.Segment, c.Offset
+}
+
+// SeekReader advances reader past every record up to the checkpointed
+// position without processing them, so the caller resumes exactly where it
+// left off. It returns pending=true if the checkpointed segment has already
+// been garbage collected: reader will then already be positioned at the
+// oldest available segment, on a record that was never processed, and
+// since a wal.Reader has no way to "unread" it, the caller must process
+// that record itself (via reader.Record()) before calling reader.Next()
+// again.
+func (p *Progress) SeekReader(reader *wal.Reader) (pending bool, err error) {
+	segment, offset, ok := p.Position()
+	if !ok {
+		return false, nil
+	}
+	level.Info(p.logger).Log("msg", "Resuming WAL from checkpoint", "segment", segment, "offset", offset)
+	for reader.Next() {
+		if reader.Segment() > segment {
+			level.Warn(p.logger).Log("msg", "Checkpointed WAL segment is gone, resuming from the oldest available one", "checkpoint_segment", segment, "segment", reader.Segment())
+			return true, reader.Err()
+		}
+		if reader.Segment() == segment && reader.Offset() >= offset {
+			break
+		}
+	}
+	return false, reader.Err()
+}
+
+// UpdateLag records how many segments behind the newest available segment
+// the reader currently is.
+func (p *Progress) UpdateLag(newestSegment int) {
+	readLagSegments.Set(float64(newestSegment - p.segment))
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"io/ioutil"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var samplesFilteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sidecar_samples_filtered_total",
+	Help: "Number of samples that were dropped or relabeled by --include.config-file rules.",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(samplesFilteredTotal)
+}
+
+// relabelFilterConfig is the on-disk shape of the --include.config-file
+// file. It intentionally mirrors the `relabel_configs` stanza of a
+// Prometheus scrape config, so operators can reuse rules they already know.
+type relabelFilterConfig struct {
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+}
+
+// relabelFilter applies a set of Prometheus-style relabel_config rules to
+// the label set of every sample before it reaches the appender, so
+// high-cardinality series can be dropped and labels rewritten to match
+// Stackdriver monitored-resource conventions without redeploying
+// Prometheus. The rule set can be swapped out at runtime via Reload.
+type relabelFilter struct {
+	logger log.Logger
+	path   string
+
+	mtx     sync.RWMutex
+	configs []*relabel.Config
+}
+
+// newRelabelFilter constructs a relabelFilter. If path is empty, Filter is a
+// no-op passthrough.
+func newRelabelFilter(logger log.Logger, path string) *relabelFilter {
+	f := &relabelFilter{logger: logger, path: path}
+	if path != "" {
+		if err := f.Reload(); err != nil {
+			level.Error(logger).Log("msg", "Cannot load relabel config, starting with no rules", "err", err)
+		}
+	}
+	return f
+}
+
+// Reload re-reads the rules from path. It's safe to call concurrently with
+// Filter, typically from a SIGHUP handler.
+func (f *relabelFilter) Reload() error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return errors.Wrap(err, "read relabel config file")
+	}
+	var cfg relabelFilterConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return errors.Wrap(err, "parse relabel config file")
+	}
+	f.mtx.Lock()
+	f.configs = cfg.RelabelConfigs
+	f.mtx.Unlock()
+	level.Info(f.logger).Log("msg", "Reloaded relabel config", "file", f.path, "num_rules", len(cfg.RelabelConfigs))
+	return nil
+}
+
+// Filter applies the current rules to lset. It returns the resulting label
+// set and whether the series should be kept.
+func (f *relabelFilter) Filter(lset labels.Labels) (labels.Labels, bool) {
+	f.mtx.RLock()
+	configs := f.configs
+	f.mtx.RUnlock()
+
+	if len(configs) == 0 {
+		return lset, true
+	}
+	out := relabel.Process(lset, configs...)
+	if out == nil {
+		samplesFilteredTotal.WithLabelValues("drop").Inc()
+		return nil, false
+	}
+	if !labels.Equal(out, lset) {
+		samplesFilteredTotal.WithLabelValues("relabel").Inc()
+	}
+	return out, true
+}
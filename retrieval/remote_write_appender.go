@@ -0,0 +1,170 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/Stackdriver/stackdriver-prometheus-sidecar/remotewrite"
+)
+
+// remoteWriteBatchSize and remoteWriteFlushInterval bound how long samples
+// sit in the batch before being shipped, trading a little latency for far
+// fewer, larger remote_write requests.
+const (
+	remoteWriteBatchSize     = 500
+	remoteWriteFlushInterval = 5 * time.Second
+)
+
+// remoteWriteAppender adapts a remotewrite.Client, which speaks in
+// prompb.WriteRequest, to the sidecar's Appender interface, which speaks in
+// the reader's reconstructed MetricFamily.
+type remoteWriteAppender struct {
+	logger log.Logger
+	client *remotewrite.Client
+
+	mtx   sync.Mutex
+	batch []prompb.TimeSeries
+}
+
+// NewRemoteWriteAppender adapts client to the Appender interface so it can
+// be used as one of MultiAppender's sinks.
+func NewRemoteWriteAppender(logger log.Logger, client *remotewrite.Client) Appender {
+	a := &remoteWriteAppender{logger: logger, client: client}
+	go a.runFlusher()
+	return a
+}
+
+func (a *remoteWriteAppender) runFlusher() {
+	ticker := time.NewTicker(remoteWriteFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.flush()
+	}
+}
+
+// Append converts f into one or more prompb.TimeSeries -- a histogram or
+// summary family becomes its _bucket/_sum/_count (or quantile) siblings
+// again, the same shape Prometheus originally scraped -- and buffers them
+// for the next flush.
+func (a *remoteWriteAppender) Append(f *MetricFamily) {
+	series := toTimeSeries(f)
+
+	a.mtx.Lock()
+	a.batch = append(a.batch, series...)
+	full := len(a.batch) >= remoteWriteBatchSize
+	a.mtx.Unlock()
+
+	if full {
+		a.flush()
+	}
+}
+
+// Close flushes whatever is currently buffered instead of waiting for the
+// next periodic tick, so a graceful shutdown doesn't drop the last
+// partial batch.
+func (a *remoteWriteAppender) Close() {
+	a.flush()
+}
+
+func (a *remoteWriteAppender) flush() {
+	a.mtx.Lock()
+	if len(a.batch) == 0 {
+		a.mtx.Unlock()
+		return
+	}
+	batch := a.batch
+	a.batch = nil
+	a.mtx.Unlock()
+
+	req := &prompb.WriteRequest{Timeseries: batch}
+	if err := a.client.Store(context.Background(), req); err != nil {
+		sinkFailedTotal.WithLabelValues(a.client.Name()).Inc()
+		level.Warn(a.logger).Log("msg", "Cannot send batch to remote_write endpoint", "err", err)
+	}
+}
+
+// toTimeSeries unrolls a MetricFamily (which may describe a reconstructed
+// histogram or summary) back into the individual series Prometheus exposes
+// them as, since the remote_write wire format has no histogram/summary
+// message of its own.
+func toTimeSeries(f *MetricFamily) []prompb.TimeSeries {
+	var out []prompb.TimeSeries
+	for _, metric := range f.Metric {
+		switch f.GetType() {
+		case dto.MetricType_HISTOGRAM:
+			h := metric.GetHistogram()
+			for _, b := range h.GetBucket() {
+				out = append(out, newTimeSeries(f.GetName()+"_bucket", metric, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound())))
+			}
+			out = append(out, newTimeSeries(f.GetName()+"_sum", metric, h.GetSampleSum()))
+			out = append(out, newTimeSeries(f.GetName()+"_count", metric, float64(h.GetSampleCount())))
+		case dto.MetricType_SUMMARY:
+			s := metric.GetSummary()
+			for _, q := range s.GetQuantile() {
+				out = append(out, newTimeSeries(f.GetName(), metric, q.GetValue(), "quantile", formatFloat(q.GetQuantile())))
+			}
+			out = append(out, newTimeSeries(f.GetName()+"_sum", metric, s.GetSampleSum()))
+			out = append(out, newTimeSeries(f.GetName()+"_count", metric, float64(s.GetSampleCount())))
+		default:
+			out = append(out, newTimeSeries(f.GetName(), metric, metricValue(metric)))
+		}
+	}
+	return out
+}
+
+// newTimeSeries builds a single prompb.TimeSeries for name out of metric's
+// existing labels, an optional extra label pair (used for "le" and
+// "quantile"), and value.
+func newTimeSeries(name string, metric *dto.Metric, value float64, extraLabel ...string) prompb.TimeSeries {
+	lbls := make([]prompb.Label, 0, len(metric.GetLabel())+2)
+	lbls = append(lbls, prompb.Label{Name: "__name__", Value: name})
+	for _, l := range metric.GetLabel() {
+		lbls = append(lbls, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	if len(extraLabel) == 2 {
+		lbls = append(lbls, prompb.Label{Name: extraLabel[0], Value: extraLabel[1]})
+	}
+	return prompb.TimeSeries{
+		Labels: lbls,
+		Samples: []prompb.Sample{{
+			Value:     value,
+			Timestamp: metric.GetTimestampMs(),
+		}},
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue()
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue()
+	default:
+		return metric.GetUntyped().GetValue()
+	}
+}
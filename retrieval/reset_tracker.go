@@ -0,0 +1,136 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	resetsDetected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sidecar_resets_detected_total",
+		Help: "Number of counter resets detected across all tracked series.",
+	})
+	resetTrackerSeries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sidecar_reset_tracker_series",
+		Help: "Number of series currently tracked for counter resets.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(resetsDetected, resetTrackerSeries)
+}
+
+// resetTrackerFile is the name of the file the resetTracker persists its
+// state to, inside the WAL directory.
+const resetTrackerFile = "sidecar_reset_tracker.json"
+
+// resetState is what resetTracker remembers about a single series.
+type resetState struct {
+	LastValue   float64 `json:"last_value"`
+	ResetTimeMs int64   `json:"reset_time_ms"`
+}
+
+// resetTracker is the sibling of seriesCache that remembers, for every
+// series ref, the timestamp of the most recent counter reset Prometheus
+// wrote to the WAL. Stackdriver requires this as the start time of a
+// CUMULATIVE point.
+type resetTracker struct {
+	logger log.Logger
+	path   string
+
+	mtx   sync.Mutex
+	state map[uint64]*resetState
+}
+
+func newResetTracker(logger log.Logger, walDirectory string) *resetTracker {
+	t := &resetTracker{
+		logger: logger,
+		path:   filepath.Join(walDirectory, resetTrackerFile),
+		state:  make(map[uint64]*resetState),
+	}
+	t.load()
+	return t
+}
+
+// getResetTimestamp records sample (ref, v, t), detects whether it
+// represents a counter reset relative to the last sample seen for ref, and
+// returns the timestamp, in milliseconds, that should be used as the start
+// time of the CUMULATIVE point.
+func (t *resetTracker) getResetTimestamp(ref uint64, v float64, ts int64) int64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	s, ok := t.state[ref]
+	if !ok {
+		s = &resetState{ResetTimeMs: ts - 1}
+		t.state[ref] = s
+		resetsDetected.Inc()
+		resetTrackerSeries.Set(float64(len(t.state)))
+	} else if v < s.LastValue {
+		s.ResetTimeMs = ts - 1
+		resetsDetected.Inc()
+	}
+	s.LastValue = v
+	return s.ResetTimeMs
+}
+
+// persist fsyncs the current tracker state to disk so a sidecar restart does
+// not mistake every series for newly seen and emit a spurious reset.
+func (t *resetTracker) persist() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	tmp := t.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(t.state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+func (t *resetTracker) load() {
+	f, err := os.Open(t.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(t.logger).Log("msg", "Cannot read reset tracker state, starting fresh", "err", err)
+		}
+		return
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&t.state); err != nil {
+		level.Warn(t.logger).Log("msg", "Cannot decode reset tracker state, starting fresh", "err", err)
+		t.state = make(map[uint64]*resetState)
+		return
+	}
+	resetTrackerSeries.Set(float64(len(t.state)))
+}